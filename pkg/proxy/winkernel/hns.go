@@ -0,0 +1,114 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package winkernel
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/hnslib/hcn"
+)
+
+// errorNotImplemented is the Win32 E_NOTIMPL HRESULT that HNS returns when
+// a running version of the platform doesn't implement a given API, e.g.
+// an older HNS that hasn't learned ModifyLoadBalancer yet.
+const errorNotImplemented = syscall.Errno(0x80004001)
+
+// IsNotImplemented reports whether err is (or wraps) the E_NOTIMPL error
+// HNS returns for calls it doesn't support, so callers can fall back to a
+// supported code path instead of failing outright. An error that carries
+// no syscall.Errno is also reported as not implemented when its message
+// contains "not implemented".
+func IsNotImplemented(err error) bool {
+	if err == nil {
+		return false
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno == errorNotImplemented
+	}
+	return strings.Contains(err.Error(), "not implemented")
+}
+
+// HcnUtils abstracts the subset of the HCN v2 API the Windows kernelspace
+// proxier depends on, so it can be exercised against HcnMock in tests.
+type HcnUtils interface {
+	GetNetworkByName(networkName string) (*hcn.HostComputeNetwork, error)
+	GetNetworkByID(networkID string) (*hcn.HostComputeNetwork, error)
+	ListEndpoints() ([]hcn.HostComputeEndpoint, error)
+	ListEndpointsOfNetwork(networkId string) ([]hcn.HostComputeEndpoint, error)
+	GetEndpointByID(endpointId string) (*hcn.HostComputeEndpoint, error)
+	GetEndpointByName(endpointName string) (*hcn.HostComputeEndpoint, error)
+	CreateEndpoint(network *hcn.HostComputeNetwork, endpoint *hcn.HostComputeEndpoint) (*hcn.HostComputeEndpoint, error)
+	CreateRemoteEndpoint(network *hcn.HostComputeNetwork, endpoint *hcn.HostComputeEndpoint) (*hcn.HostComputeEndpoint, error)
+	DeleteEndpoint(endpoint *hcn.HostComputeEndpoint) error
+	AddVIPToEndpoint(endpointID, vip string) error
+	RemoveVIPFromEndpoint(endpointID, vip string) error
+	ListLoadBalancers() ([]hcn.HostComputeLoadBalancer, error)
+	GetLoadBalancerByID(loadBalancerId string) (*hcn.HostComputeLoadBalancer, error)
+	GetLoadBalancerFlags(id string) (hcn.LoadBalancerFlags, hcn.LoadBalancerPortMappingFlags, error)
+	CreateLoadBalancer(loadBalancer *hcn.HostComputeLoadBalancer) (*hcn.HostComputeLoadBalancer, error)
+	UpdateLoadBalancer(loadBalancer *hcn.HostComputeLoadBalancer, hnsLbID string) (*hcn.HostComputeLoadBalancer, error)
+	DeleteLoadBalancer(loadBalancer *hcn.HostComputeLoadBalancer) error
+	GetSupportedFeatures() hcn.SupportedFeatures
+	Ipv6DualStackSupported() error
+	DsrSupported() error
+	ModifyLoadBalancerSupported() error
+	DeleteAllHnsLoadBalancerPolicy()
+	RemoteSubnetSupported() error
+}
+
+// hns wraps an HcnUtils implementation with the reconciliation policies
+// the proxier relies on, such as preferring an in-place load balancer
+// update over a disruptive delete-then-create.
+type hns struct {
+	hcn HcnUtils
+}
+
+// updateLoadBalancer reconciles hnsLB to match desired, updating it in
+// place when the platform supports ModifyLoadbalancer so that in-flight
+// connections survive a Service's endpoint set changing (e.g. a rolling
+// update). It falls back to deleting and recreating the load balancer
+// when the feature isn't advertised, or when HNS reports the update call
+// itself as not implemented.
+func (h *hns) updateLoadBalancer(hnsLB *hcn.HostComputeLoadBalancer, desired *hcn.HostComputeLoadBalancer) (*hcn.HostComputeLoadBalancer, error) {
+	if err := h.hcn.ModifyLoadBalancerSupported(); err != nil {
+		return h.recreateLoadBalancer(hnsLB, desired)
+	}
+	updated, err := h.hcn.UpdateLoadBalancer(desired, hnsLB.Id)
+	if err != nil {
+		if IsNotImplemented(err) {
+			return h.recreateLoadBalancer(hnsLB, desired)
+		}
+		return nil, err
+	}
+	return updated, nil
+}
+
+// recreateLoadBalancer deletes hnsLB and creates desired in its place. It
+// is the only reconciliation path available on platforms that don't
+// support in-place load balancer updates.
+func (h *hns) recreateLoadBalancer(hnsLB *hcn.HostComputeLoadBalancer, desired *hcn.HostComputeLoadBalancer) (*hcn.HostComputeLoadBalancer, error) {
+	if err := h.hcn.DeleteLoadBalancer(hnsLB); err != nil {
+		return nil, err
+	}
+	return h.hcn.CreateLoadBalancer(desired)
+}
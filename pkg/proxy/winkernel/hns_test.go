@@ -0,0 +1,228 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package winkernel
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/Microsoft/hnslib/hcn"
+	wktesting "k8s.io/kubernetes/pkg/proxy/winkernel/testing"
+)
+
+// notImplementedUpdateHcnUtils wraps a real HcnMock but makes
+// UpdateLoadBalancer always fail with E_NOTIMPL, simulating an HNS build
+// that advertises ModifyLoadbalancer support yet hasn't actually wired up
+// the call.
+type notImplementedUpdateHcnUtils struct {
+	*wktesting.HcnMock
+}
+
+func (m *notImplementedUpdateHcnUtils) UpdateLoadBalancer(loadBalancer *hcn.HostComputeLoadBalancer, hnsLbID string) (*hcn.HostComputeLoadBalancer, error) {
+	return nil, syscall.Errno(0x80004001)
+}
+
+func newTestLoadBalancer(endpoints []string) *hcn.HostComputeLoadBalancer {
+	return &hcn.HostComputeLoadBalancer{
+		HostComputeEndpoints: endpoints,
+		SourceVIP:            "10.0.0.1",
+		FrontendVIPs:         []string{"10.0.0.100"},
+		PortMappings:         []hcn.LoadBalancerPortMapping{newTestPortMapping()},
+	}
+}
+
+// TestHnsUpdateLoadBalancerInPlace verifies that hns.updateLoadBalancer
+// reconciles an existing load balancer via HcnUtils.UpdateLoadBalancer
+// (keeping its id) when ModifyLoadbalancer is supported.
+func TestHnsUpdateLoadBalancerInPlace(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"})
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+	h := &hns{hcn: hcnMock}
+
+	existing, err := hcnMock.CreateLoadBalancer(newTestLoadBalancer([]string{ep.Id}))
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	desired := newTestLoadBalancer([]string{ep.Id})
+	desired.PortMappings[0].DistributionType = hcn.LoadBalancerDistribution(2)
+	updated, err := h.updateLoadBalancer(existing, desired)
+	if err != nil {
+		t.Fatalf("unexpected error updating load balancer in place: %v", err)
+	}
+	if updated.Id != existing.Id {
+		t.Errorf("expected in-place update to keep id %s, got %s", existing.Id, updated.Id)
+	}
+	if updated.PortMappings[0].DistributionType != hcn.LoadBalancerDistribution(2) {
+		t.Errorf("expected updated DistributionType 2, got %v", updated.PortMappings[0].DistributionType)
+	}
+}
+
+// TestHnsUpdateLoadBalancerFallsBackWhenUnsupported verifies that
+// hns.updateLoadBalancer deletes and recreates the load balancer, rather
+// than calling UpdateLoadBalancer, when ModifyLoadBalancerSupported
+// reports the capability unavailable.
+func TestHnsUpdateLoadBalancerFallsBackWhenUnsupported(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"})
+	hcnMock.SetModifyLoadbalancerSupported(false)
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+	h := &hns{hcn: hcnMock}
+
+	existing, err := hcnMock.CreateLoadBalancer(newTestLoadBalancer([]string{ep.Id}))
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	desired := newTestLoadBalancer([]string{ep.Id})
+	desired.PortMappings[0].DistributionType = hcn.LoadBalancerDistribution(2)
+	updated, err := h.updateLoadBalancer(existing, desired)
+	if err != nil {
+		t.Fatalf("unexpected error falling back to recreate: %v", err)
+	}
+	if updated.Id == existing.Id {
+		t.Errorf("expected recreate fallback to assign a new id, got the same id %s", existing.Id)
+	}
+	if _, err := hcnMock.GetLoadBalancerByID(existing.Id); err == nil {
+		t.Errorf("expected the old load balancer %s to have been deleted", existing.Id)
+	}
+}
+
+// TestHnsUpdateLoadBalancerFallsBackOnNotImplemented verifies that
+// hns.updateLoadBalancer falls back to delete-then-create when HNS
+// reports the platform supports ModifyLoadbalancer but the update call
+// itself returns E_NOTIMPL.
+func TestHnsUpdateLoadBalancerFallsBackOnNotImplemented(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"})
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+	existing, err := hcnMock.CreateLoadBalancer(newTestLoadBalancer([]string{ep.Id}))
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	h := &hns{hcn: &notImplementedUpdateHcnUtils{HcnMock: hcnMock}}
+
+	desired := newTestLoadBalancer([]string{ep.Id})
+	desired.PortMappings[0].DistributionType = hcn.LoadBalancerDistribution(2)
+	updated, err := h.updateLoadBalancer(existing, desired)
+	if err != nil {
+		t.Fatalf("unexpected error falling back to recreate on E_NOTIMPL: %v", err)
+	}
+	if updated.Id == existing.Id {
+		t.Errorf("expected recreate fallback to assign a new id, got the same id %s", existing.Id)
+	}
+	if _, err := hcnMock.GetLoadBalancerByID(existing.Id); err == nil {
+		t.Errorf("expected the old load balancer %s to have been deleted", existing.Id)
+	}
+}
+
+// TestSyncServiceLoadBalancerCreatesWhenAbsent verifies that
+// Proxier.syncServiceLoadBalancer creates a new load balancer outright
+// when none exists yet for the service.
+func TestSyncServiceLoadBalancerCreatesWhenAbsent(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"})
+	proxier := NewProxier(hcnMock, false, "")
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+
+	desired := newTestLoadBalancer([]string{ep.Id})
+	created, err := proxier.syncServiceLoadBalancer("default/svc", nil, desired, []string{ep.Id})
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+	if created.Id == "" {
+		t.Error("expected a newly created load balancer to have an id")
+	}
+}
+
+// TestSyncServiceLoadBalancerFallsBackWhenUnsupported verifies that
+// Proxier.syncServiceLoadBalancer itself (not just hns.updateLoadBalancer
+// in isolation) falls back to delete-then-create when
+// ModifyLoadBalancerSupported reports the capability unavailable.
+func TestSyncServiceLoadBalancerFallsBackWhenUnsupported(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"})
+	hcnMock.SetModifyLoadbalancerSupported(false)
+	proxier := NewProxier(hcnMock, false, "")
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+
+	desired := newTestLoadBalancer([]string{ep.Id})
+	created, err := proxier.syncServiceLoadBalancer("default/svc", nil, desired, []string{ep.Id})
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	changed := newTestLoadBalancer([]string{ep.Id})
+	changed.PortMappings[0].DistributionType = hcn.LoadBalancerDistribution(2)
+	updated, err := proxier.syncServiceLoadBalancer("default/svc", created, changed, []string{ep.Id})
+	if err != nil {
+		t.Fatalf("unexpected error falling back to recreate: %v", err)
+	}
+	if updated.Id == created.Id {
+		t.Errorf("expected recreate fallback to assign a new id, got the same id %s", created.Id)
+	}
+	if _, err := hcnMock.GetLoadBalancerByID(created.Id); err == nil {
+		t.Errorf("expected the old load balancer %s to have been deleted", created.Id)
+	}
+}
+
+// TestSyncServiceLoadBalancerFallsBackOnNotImplemented verifies that
+// Proxier.syncServiceLoadBalancer falls back to delete-then-create when
+// HNS reports the platform supports ModifyLoadbalancer but the update
+// call itself returns E_NOTIMPL.
+func TestSyncServiceLoadBalancerFallsBackOnNotImplemented(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"})
+	proxier := NewProxier(&notImplementedUpdateHcnUtils{HcnMock: hcnMock}, false, "")
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+
+	desired := newTestLoadBalancer([]string{ep.Id})
+	created, err := proxier.syncServiceLoadBalancer("default/svc", nil, desired, []string{ep.Id})
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	changed := newTestLoadBalancer([]string{ep.Id})
+	changed.PortMappings[0].DistributionType = hcn.LoadBalancerDistribution(2)
+	updated, err := proxier.syncServiceLoadBalancer("default/svc", created, changed, []string{ep.Id})
+	if err != nil {
+		t.Fatalf("unexpected error falling back to recreate on E_NOTIMPL: %v", err)
+	}
+	if updated.Id == created.Id {
+		t.Errorf("expected recreate fallback to assign a new id, got the same id %s", created.Id)
+	}
+	if _, err := hcnMock.GetLoadBalancerByID(created.Id); err == nil {
+		t.Errorf("expected the old load balancer %s to have been deleted", created.Id)
+	}
+}
@@ -0,0 +1,321 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package winkernel
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Microsoft/hnslib/hcn"
+)
+
+// distributionTypeForService translates a Service's session affinity into
+// the HNS DistributionType its load balancer should be created/updated
+// with: per-connection by default, or per-client-IP when the Service asks
+// for ClientIP affinity so repeat connections from the same client land
+// on the same endpoint.
+func distributionTypeForService(svc *v1.Service) hcn.LoadBalancerDistribution {
+	if svc.Spec.SessionAffinity != v1.ServiceAffinityClientIP {
+		return hcn.LoadBalancerDistribution(0) // per-connection
+	}
+	// HNS's LoadBalancerPortMapping has no affinity-timeout knob today, so
+	// SessionAffinityConfig.ClientIP.TimeoutSeconds isn't threaded any
+	// further than selecting per-client-IP distribution.
+	return hcn.LoadBalancerDistribution(2) // per-client-IP
+}
+
+// portMappingFlagsForService translates Service.Spec.ExternalTrafficPolicy
+// into the port-mapping flag that preserves the client's source IP:
+// ExternalTrafficPolicy: Local routes traffic only to node-local
+// endpoints, so HNS is told to skip the SNAT it would otherwise apply.
+func portMappingFlagsForService(svc *v1.Service) hcn.LoadBalancerPortMappingFlags {
+	var flags hcn.LoadBalancerPortMappingFlags
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyLocal {
+		flags |= hcn.LoadBalancerPortMappingFlagsLocalRoutedVIP
+	}
+	return flags
+}
+
+// internalTrafficPolicyPortMappingFlags translates
+// Service.Spec.InternalTrafficPolicy into the ILB port-mapping flag:
+// InternalTrafficPolicy: Local likewise restricts an internal (ClusterIP)
+// load balancer to node-local endpoints. This is a LoadBalancerPortMapping
+// flag, not a HostComputeLoadBalancer.Flags value, despite "ILB" standing
+// for "internal load balancer" at the LB level conceptually.
+func internalTrafficPolicyPortMappingFlags(svc *v1.Service) hcn.LoadBalancerPortMappingFlags {
+	var flags hcn.LoadBalancerPortMappingFlags
+	if svc.Spec.InternalTrafficPolicy != nil && *svc.Spec.InternalTrafficPolicy == v1.ServiceInternalTrafficPolicyLocal {
+		flags |= hcn.LoadBalancerPortMappingFlagsILB
+	}
+	return flags
+}
+
+// buildDesiredLoadBalancer assembles the HostComputeLoadBalancer that
+// should exist in HNS for svc, translating Service-level fields (session
+// affinity and traffic policy) into the matching HCN settings.
+func (proxier *Proxier) buildDesiredLoadBalancer(svc *v1.Service, sourceVip string, frontendVip string, portMapping hcn.LoadBalancerPortMapping, endpoints []string) *hcn.HostComputeLoadBalancer {
+	portMapping.DistributionType = distributionTypeForService(svc)
+	portMapping.Flags |= portMappingFlagsForService(svc) | internalTrafficPolicyPortMappingFlags(svc)
+	return &hcn.HostComputeLoadBalancer{
+		HostComputeEndpoints: endpoints,
+		SourceVIP:            sourceVip,
+		FrontendVIPs:         []string{frontendVip},
+		PortMappings:         []hcn.LoadBalancerPortMapping{portMapping},
+	}
+}
+
+// Proxier programs HNS load balancers for Kubernetes Services on Windows
+// nodes. Only load balancer reconciliation and the shared load-balancing
+// endpoint are modeled here.
+type Proxier struct {
+	hns *hns
+
+	// endpointsSynced records the endpoint IDs last programmed for each
+	// service's HNS load balancer, so syncServiceLoadBalancer can detect
+	// when a Service's endpoint set has actually changed.
+	endpointsSynced map[string][]string
+
+	// desiredSynced records the full desired load balancer spec last
+	// programmed for each service, so syncServiceLoadBalancer also
+	// reconciles in place when something other than the endpoint set
+	// changes, e.g. a Service's SessionAffinity flipping to ClientIP.
+	desiredSynced map[string]*hcn.HostComputeLoadBalancer
+
+	// sharedLBEndpointEnabled mirrors the --winkernel-shared-lb-endpoint
+	// flag. When set, ClusterIP services are programmed by assigning
+	// their VIP to a single shared HostComputeEndpoint per network
+	// instead of adding LB policy to every workload endpoint, so LB
+	// state no longer grows with the number of Services in a cluster.
+	sharedLBEndpointEnabled bool
+
+	// sharedEndpointSourceIP, when non-empty, is set as the IP address of
+	// each shared endpoint that ensureSharedEndpoint creates. No SNAT
+	// policy for return traffic is programmed from it.
+	sharedEndpointSourceIP string
+
+	// sharedEndpoints holds the one HostComputeEndpoint created per HNS
+	// network, keyed by network Id.
+	sharedEndpoints map[string]*hcn.HostComputeEndpoint
+
+	// clusterIPServiceVIPs records the VIP last assigned to the shared
+	// endpoint for each ClusterIP service, so a later sync can garbage
+	// collect VIPs whose Service no longer exists.
+	clusterIPServiceVIPs map[string]string
+
+	// serviceLoadBalancers records the dedicated HNS load balancer last
+	// programmed for each service under the legacy (non-shared-endpoint)
+	// path, so a later sync can reconcile it in place.
+	serviceLoadBalancers map[string]*hcn.HostComputeLoadBalancer
+}
+
+// NewProxier returns a Proxier backed by hcnImpl. sharedLBEndpointEnabled
+// and sharedEndpointSourceIP configure the shared load-balancing endpoint
+// subsystem (see syncClusterIPService); callers that don't use it may
+// pass false and "".
+func NewProxier(hcnImpl HcnUtils, sharedLBEndpointEnabled bool, sharedEndpointSourceIP string) *Proxier {
+	return &Proxier{
+		hns:                     &hns{hcn: hcnImpl},
+		endpointsSynced:         make(map[string][]string),
+		desiredSynced:           make(map[string]*hcn.HostComputeLoadBalancer),
+		sharedLBEndpointEnabled: sharedLBEndpointEnabled,
+		sharedEndpointSourceIP:  sharedEndpointSourceIP,
+		sharedEndpoints:         make(map[string]*hcn.HostComputeEndpoint),
+		clusterIPServiceVIPs:    make(map[string]string),
+		serviceLoadBalancers:    make(map[string]*hcn.HostComputeLoadBalancer),
+	}
+}
+
+// isClusterIPService reports whether svc is a plain ClusterIP service,
+// the only kind eligible for the shared load-balancing endpoint: NodePort
+// and LoadBalancer services still need their own HNS load balancer for
+// the external-facing ports.
+func isClusterIPService(svc *v1.Service) bool {
+	return svc.Spec.Type == v1.ServiceTypeClusterIP || svc.Spec.Type == ""
+}
+
+// ensureSharedEndpoint returns the single HostComputeEndpoint dedicated
+// to shared ClusterIP load balancing on network, creating it on first use
+// so that every subsequent Service reuses the same endpoint instead of
+// HNS growing one endpoint per Service.
+func (proxier *Proxier) ensureSharedEndpoint(network *hcn.HostComputeNetwork) (*hcn.HostComputeEndpoint, error) {
+	if ep, ok := proxier.sharedEndpoints[network.Id]; ok {
+		return ep, nil
+	}
+	endpoint := &hcn.HostComputeEndpoint{
+		HostComputeNetwork: network.Id,
+	}
+	if proxier.sharedEndpointSourceIP != "" {
+		endpoint.IpConfigurations = []hcn.IpConfig{{IpAddress: proxier.sharedEndpointSourceIP}}
+	}
+	created, err := proxier.hns.hcn.CreateEndpoint(network, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	proxier.sharedEndpoints[network.Id] = created
+	return created, nil
+}
+
+// syncClusterIPService programs svc's VIP using the shared load-balancing
+// endpoint: the VIP is added as an alias of the network's shared endpoint
+// via AddVIPToEndpoint rather than by creating a dedicated LoadBalancer.
+// If the platform's HCN lacks AddVIPToEndpoint support, it falls back to
+// the legacy per-service path built from buildDesiredLoadBalancer.
+func (proxier *Proxier) syncClusterIPService(svc *v1.Service, network *hcn.HostComputeNetwork, sourceVip string, vip string, portMapping hcn.LoadBalancerPortMapping, endpoints []string) error {
+	if !proxier.sharedLBEndpointEnabled || !isClusterIPService(svc) {
+		return proxier.syncClusterIPServiceLegacy(svc, sourceVip, vip, portMapping, endpoints)
+	}
+	sharedEndpoint, err := proxier.ensureSharedEndpoint(network)
+	if err != nil {
+		if IsNotImplemented(err) {
+			return proxier.syncClusterIPServiceLegacy(svc, sourceVip, vip, portMapping, endpoints)
+		}
+		return err
+	}
+	if err := proxier.hns.hcn.AddVIPToEndpoint(sharedEndpoint.Id, vip); err != nil {
+		if IsNotImplemented(err) {
+			return proxier.syncClusterIPServiceLegacy(svc, sourceVip, vip, portMapping, endpoints)
+		}
+		return err
+	}
+	proxier.clusterIPServiceVIPs[serviceKey(svc)] = vip
+	return nil
+}
+
+// syncClusterIPServiceLegacy programs svc's VIP as a dedicated HNS load
+// balancer, the pre-shared-endpoint behavior. It's used directly when the
+// shared endpoint subsystem is disabled, and as the fallback when HCN
+// doesn't support it.
+func (proxier *Proxier) syncClusterIPServiceLegacy(svc *v1.Service, sourceVip string, vip string, portMapping hcn.LoadBalancerPortMapping, endpoints []string) error {
+	svcKey := serviceKey(svc)
+	desired := proxier.buildDesiredLoadBalancer(svc, sourceVip, vip, portMapping, endpoints)
+	updated, err := proxier.syncServiceLoadBalancer(svcKey, proxier.serviceLoadBalancers[svcKey], desired, endpoints)
+	if err != nil {
+		return err
+	}
+	proxier.serviceLoadBalancers[svcKey] = updated
+	return nil
+}
+
+// gcSharedEndpointVIPs removes VIPs from network's shared endpoint that
+// belong to a ClusterIP service no longer present in liveServices, so
+// deleted Services don't leak VIPs on the shared endpoint forever.
+func (proxier *Proxier) gcSharedEndpointVIPs(network *hcn.HostComputeNetwork, liveServices map[string]bool) error {
+	sharedEndpoint, ok := proxier.sharedEndpoints[network.Id]
+	if !ok {
+		return nil
+	}
+	for svcKey, vip := range proxier.clusterIPServiceVIPs {
+		if liveServices[svcKey] {
+			continue
+		}
+		if err := proxier.hns.hcn.RemoveVIPFromEndpoint(sharedEndpoint.Id, vip); err != nil {
+			return err
+		}
+		delete(proxier.clusterIPServiceVIPs, svcKey)
+	}
+	return nil
+}
+
+// serviceKey returns the namespaced name used to key per-service proxier
+// state.
+func serviceKey(svc *v1.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
+
+// syncServiceLoadBalancer ensures svcName's HNS load balancer matches
+// desired. When hnsLB is nil there is nothing to reconcile against and a
+// new load balancer is created outright. When neither the endpoint set
+// nor the rest of the desired spec (session affinity, traffic-policy
+// flags, ...) has changed since the last sync, the existing load balancer
+// is left alone. Otherwise the load balancer is updated in place via
+// hns.updateLoadBalancer, which itself falls back to delete-then-create
+// when in-place updates aren't supported.
+func (proxier *Proxier) syncServiceLoadBalancer(svcName string, hnsLB *hcn.HostComputeLoadBalancer, desired *hcn.HostComputeLoadBalancer, newEndpoints []string) (*hcn.HostComputeLoadBalancer, error) {
+	if hnsLB == nil {
+		created, err := proxier.hns.hcn.CreateLoadBalancer(desired)
+		if err != nil {
+			return nil, err
+		}
+		proxier.endpointsSynced[svcName] = newEndpoints
+		proxier.desiredSynced[svcName] = desired
+		return created, nil
+	}
+	if endpointSetEqual(proxier.endpointsSynced[svcName], newEndpoints) && loadBalancerSpecEqual(proxier.desiredSynced[svcName], desired) {
+		return hnsLB, nil
+	}
+	updated, err := proxier.hns.updateLoadBalancer(hnsLB, desired)
+	if err != nil {
+		return nil, err
+	}
+	proxier.endpointsSynced[svcName] = newEndpoints
+	proxier.desiredSynced[svcName] = desired
+	return updated, nil
+}
+
+// endpointSetEqual reports whether a and b contain the same endpoint IDs,
+// ignoring order.
+func endpointSetEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, id := range a {
+		seen[id]++
+	}
+	for _, id := range b {
+		seen[id]--
+		if seen[id] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBalancerSpecEqual reports whether a and b describe the same desired
+// HNS load balancer: same source/frontend VIPs and the same port mapping
+// settings (including DistributionType and Flags), so a Service edit that
+// only flips session affinity or traffic policy is detected even when its
+// endpoint set is unchanged.
+func loadBalancerSpecEqual(a, b *hcn.HostComputeLoadBalancer) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.SourceVIP != b.SourceVIP || !endpointSetEqual(a.FrontendVIPs, b.FrontendVIPs) {
+		return false
+	}
+	if len(a.PortMappings) != len(b.PortMappings) {
+		return false
+	}
+	for i := range a.PortMappings {
+		if !portMappingEqual(a.PortMappings[i], b.PortMappings[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// portMappingEqual compares the fields of a LoadBalancerPortMapping that
+// the proxier derives from Service spec.
+func portMappingEqual(a, b hcn.LoadBalancerPortMapping) bool {
+	return a.Protocol == b.Protocol &&
+		a.InternalPort == b.InternalPort &&
+		a.ExternalPort == b.ExternalPort &&
+		a.DistributionType == b.DistributionType &&
+		a.Flags == b.Flags
+}
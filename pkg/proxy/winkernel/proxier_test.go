@@ -0,0 +1,257 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package winkernel
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Microsoft/hnslib/hcn"
+	wktesting "k8s.io/kubernetes/pkg/proxy/winkernel/testing"
+)
+
+func newTestService(sessionAffinity v1.ServiceAffinity) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-svc"},
+		Spec: v1.ServiceSpec{
+			SessionAffinity: sessionAffinity,
+		},
+	}
+}
+
+func newTestPortMapping() hcn.LoadBalancerPortMapping {
+	return hcn.LoadBalancerPortMapping{Protocol: 6, InternalPort: 80, ExternalPort: 80}
+}
+
+// TestSyncServiceLoadBalancerReconcilesSessionAffinityFlip drives a
+// *v1.Service through distributionTypeForService and
+// Proxier.syncServiceLoadBalancer end to end: creating the load balancer
+// for a Service with default affinity, then flipping
+// Spec.SessionAffinity to ClientIP on an otherwise-unchanged Service and
+// confirming the existing load balancer is reconciled in place to
+// DistributionType 2, idempotently (a second sync with no further change
+// is a no-op).
+func TestSyncServiceLoadBalancerReconcilesSessionAffinityFlip(t *testing.T) {
+	hcnMock := wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1", Name: "test-network"})
+	proxier := NewProxier(hcnMock, false, "")
+
+	ep, err := hcnMock.CreateEndpoint(&hcn.HostComputeNetwork{Id: "NETID-1"}, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+	endpoints := []string{ep.Id}
+
+	svc := newTestService(v1.ServiceAffinityNone)
+	svcKey := serviceKey(svc)
+	desired := proxier.buildDesiredLoadBalancer(svc, "10.0.0.1", "10.0.0.100", newTestPortMapping(), endpoints)
+	if desired.PortMappings[0].DistributionType != hcn.LoadBalancerDistribution(0) {
+		t.Fatalf("expected per-connection DistributionType for default affinity, got %v", desired.PortMappings[0].DistributionType)
+	}
+
+	created, err := proxier.syncServiceLoadBalancer(svcKey, nil, desired, endpoints)
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	// Flip SessionAffinity to ClientIP on the same Service; the endpoint
+	// set is unchanged.
+	svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+	desired = proxier.buildDesiredLoadBalancer(svc, "10.0.0.1", "10.0.0.100", newTestPortMapping(), endpoints)
+	if desired.PortMappings[0].DistributionType != hcn.LoadBalancerDistribution(2) {
+		t.Fatalf("expected per-client-IP DistributionType for ClientIP affinity, got %v", desired.PortMappings[0].DistributionType)
+	}
+
+	updated, err := proxier.syncServiceLoadBalancer(svcKey, created, desired, endpoints)
+	if err != nil {
+		t.Fatalf("unexpected error reconciling load balancer: %v", err)
+	}
+	if updated.Id != created.Id {
+		t.Errorf("expected reconcile to update load balancer %s in place, got %s", created.Id, updated.Id)
+	}
+	if updated.PortMappings[0].DistributionType != hcn.LoadBalancerDistribution(2) {
+		t.Errorf("expected DistributionType 2 after reconcile, got %v", updated.PortMappings[0].DistributionType)
+	}
+
+	// A second sync with the same desired spec and endpoint set must be
+	// an idempotent no-op: the returned load balancer is unchanged and no
+	// further HNS call is required.
+	again, err := proxier.syncServiceLoadBalancer(svcKey, updated, desired, endpoints)
+	if err != nil {
+		t.Fatalf("unexpected error on idempotent resync: %v", err)
+	}
+	if again.Id != updated.Id {
+		t.Errorf("expected idempotent resync to leave load balancer %s alone, got %s", updated.Id, again.Id)
+	}
+}
+
+// TestBuildDesiredLoadBalancerExternalTrafficPolicyLocal verifies that a
+// Service with ExternalTrafficPolicy: Local gets the LocalRoutedVIP
+// port-mapping flag, so HNS preserves the client's source IP instead of
+// SNAT'ing it.
+func TestBuildDesiredLoadBalancerExternalTrafficPolicyLocal(t *testing.T) {
+	proxier := NewProxier(wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"}), false, "")
+
+	svc := newTestService(v1.ServiceAffinityNone)
+	svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyLocal
+
+	desired := proxier.buildDesiredLoadBalancer(svc, "10.0.0.1", "10.0.0.100", newTestPortMapping(), []string{"EPID-1"})
+	if desired.PortMappings[0].Flags&hcn.LoadBalancerPortMappingFlagsLocalRoutedVIP == 0 {
+		t.Errorf("expected LocalRoutedVIP flag for ExternalTrafficPolicy: Local, got flags %v", desired.PortMappings[0].Flags)
+	}
+}
+
+// TestBuildDesiredLoadBalancerInternalTrafficPolicyLocal verifies that a
+// Service with InternalTrafficPolicy: Local gets the ILB port-mapping
+// flag.
+func TestBuildDesiredLoadBalancerInternalTrafficPolicyLocal(t *testing.T) {
+	proxier := NewProxier(wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"}), false, "")
+
+	svc := newTestService(v1.ServiceAffinityNone)
+	local := v1.ServiceInternalTrafficPolicyLocal
+	svc.Spec.InternalTrafficPolicy = &local
+
+	desired := proxier.buildDesiredLoadBalancer(svc, "10.0.0.1", "10.0.0.100", newTestPortMapping(), []string{"EPID-1"})
+	if desired.PortMappings[0].Flags&hcn.LoadBalancerPortMappingFlagsILB == 0 {
+		t.Errorf("expected ILB flag for InternalTrafficPolicy: Local, got flags %v", desired.PortMappings[0].Flags)
+	}
+}
+
+// TestBuildDesiredLoadBalancerDefaultTrafficPolicy verifies that a
+// Service with no traffic-policy override gets neither flag.
+func TestBuildDesiredLoadBalancerDefaultTrafficPolicy(t *testing.T) {
+	proxier := NewProxier(wktesting.NewHcnMock(&hcn.HostComputeNetwork{Id: "NETID-1"}), false, "")
+
+	svc := newTestService(v1.ServiceAffinityNone)
+
+	desired := proxier.buildDesiredLoadBalancer(svc, "10.0.0.1", "10.0.0.100", newTestPortMapping(), []string{"EPID-1"})
+	if flags := desired.PortMappings[0].Flags; flags != 0 {
+		t.Errorf("expected no traffic-policy flags by default, got %v", flags)
+	}
+}
+
+func newTestClusterIPService(name string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeClusterIP},
+	}
+}
+
+// TestSyncClusterIPServiceSharesOneEndpointAcrossServices verifies the
+// shared load-balancing endpoint path end to end from the proxier side:
+// N ClusterIP services on the same network all get their VIP added to one
+// shared HostComputeEndpoint via AddVIPToEndpoint, rather than each
+// getting its own HostComputeLoadBalancer.
+func TestSyncClusterIPServiceSharesOneEndpointAcrossServices(t *testing.T) {
+	network := &hcn.HostComputeNetwork{Id: "NETID-1", Name: "test-network"}
+	hcnMock := wktesting.NewHcnMock(network)
+	proxier := NewProxier(hcnMock, true, "10.0.0.1")
+
+	ep, err := hcnMock.CreateEndpoint(network, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating workload endpoint: %v", err)
+	}
+	endpoints := []string{ep.Id}
+
+	services := map[string]string{
+		"svc-a": "10.0.0.10",
+		"svc-b": "10.0.0.11",
+		"svc-c": "10.0.0.12",
+	}
+	for name, vip := range services {
+		svc := newTestClusterIPService(name)
+		if err := proxier.syncClusterIPService(svc, network, "10.0.0.1", vip, newTestPortMapping(), endpoints); err != nil {
+			t.Fatalf("unexpected error syncing %s: %v", name, err)
+		}
+	}
+
+	lbs, err := hcnMock.ListLoadBalancers()
+	if err != nil {
+		t.Fatalf("unexpected error listing load balancers: %v", err)
+	}
+	if len(lbs) != 0 {
+		t.Errorf("expected no dedicated load balancers for shared-endpoint ClusterIP services, got %d", len(lbs))
+	}
+
+	sharedEndpoint := proxier.sharedEndpoints[network.Id]
+	if sharedEndpoint == nil {
+		t.Fatal("expected a shared endpoint to have been created")
+	}
+	if sharedEndpoint.Id == ep.Id {
+		t.Fatal("expected the shared endpoint to be distinct from the workload endpoint")
+	}
+	gotVips := hcnMock.GetEndpointVIPs(sharedEndpoint.Id)
+	if len(gotVips) != len(services) {
+		t.Errorf("expected %d VIPs on the shared endpoint, got %d: %v", len(services), len(gotVips), gotVips)
+	}
+
+	// gcSharedEndpointVIPs must remove the VIP for a service that no
+	// longer exists, and leave the others untouched.
+	if err := proxier.gcSharedEndpointVIPs(network, map[string]bool{"default/svc-b": true, "default/svc-c": true}); err != nil {
+		t.Fatalf("unexpected error garbage collecting VIPs: %v", err)
+	}
+	gotVips = hcnMock.GetEndpointVIPs(sharedEndpoint.Id)
+	if len(gotVips) != len(services)-1 {
+		t.Errorf("expected %d VIPs after GC, got %d: %v", len(services)-1, len(gotVips), gotVips)
+	}
+	for _, vip := range gotVips {
+		if vip == services["svc-a"] {
+			t.Errorf("expected GC to remove svc-a's VIP %s, but it's still present", vip)
+		}
+	}
+}
+
+// TestSyncClusterIPServiceLegacyWhenDisabled verifies that disabling the
+// shared-endpoint feature flag falls back to a dedicated load balancer per
+// ClusterIP service, the pre-existing behavior.
+func TestSyncClusterIPServiceLegacyWhenDisabled(t *testing.T) {
+	network := &hcn.HostComputeNetwork{Id: "NETID-1", Name: "test-network"}
+	hcnMock := wktesting.NewHcnMock(network)
+	proxier := NewProxier(hcnMock, false, "")
+
+	ep, err := hcnMock.CreateEndpoint(network, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating workload endpoint: %v", err)
+	}
+
+	svc := newTestClusterIPService("svc-a")
+	if err := proxier.syncClusterIPService(svc, network, "10.0.0.1", "10.0.0.10", newTestPortMapping(), []string{ep.Id}); err != nil {
+		t.Fatalf("unexpected error syncing svc-a: %v", err)
+	}
+
+	lbs, err := hcnMock.ListLoadBalancers()
+	if err != nil {
+		t.Fatalf("unexpected error listing load balancers: %v", err)
+	}
+	// ListLoadBalancers ranges over loadbalancerMap, which indexes each
+	// load balancer under both its Id and its frontend key, so every load
+	// balancer appears twice; dedupe by Id before counting.
+	seenIds := make(map[string]bool)
+	for _, lb := range lbs {
+		seenIds[lb.Id] = true
+	}
+	if len(seenIds) != 1 {
+		t.Errorf("expected exactly one dedicated load balancer when the shared endpoint is disabled, got %d", len(seenIds))
+	}
+	if proxier.sharedEndpoints[network.Id] != nil {
+		t.Error("expected no shared endpoint to be created when the feature is disabled")
+	}
+}
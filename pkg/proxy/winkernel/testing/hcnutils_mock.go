@@ -31,6 +31,8 @@ var (
 	lbIdCounter     int
 	endpointMap     map[string]*hcn.HostComputeEndpoint
 	loadbalancerMap map[string]*hcn.HostComputeLoadBalancer
+	endpointVipMap  map[string][]string
+	flagRejections  int
 )
 
 type HcnMock struct {
@@ -56,14 +58,17 @@ func NewHcnMock(hnsNetwork *hcn.HostComputeNetwork) *HcnMock {
 	lbIdCounter = 0
 	endpointMap = make(map[string]*hcn.HostComputeEndpoint)
 	loadbalancerMap = make(map[string]*hcn.HostComputeLoadBalancer)
+	endpointVipMap = make(map[string][]string)
+	flagRejections = 0
 	return &HcnMock{
 		supportedFeatures: hcn.SupportedFeatures{
 			Api: hcn.ApiSupport{
 				V2: true,
 			},
-			DSR:           true,
-			RemoteSubnet:  true,
-			IPv6DualStack: true,
+			DSR:                true,
+			RemoteSubnet:       true,
+			IPv6DualStack:      true,
+			ModifyLoadbalancer: true,
 		},
 		network: hnsNetwork,
 	}
@@ -95,6 +100,9 @@ func (hcnObj HcnMock) GetNetworkByID(networkID string) (*hcn.HostComputeNetwork,
 	return hcnObj.network, nil
 }
 
+// ListEndpoints returns every endpoint, including any VIPs assigned to a
+// shared load-balancing endpoint via AddVIPToEndpoint, which are reported
+// as additional entries in that endpoint's IpConfigurations.
 func (hcnObj HcnMock) ListEndpoints() ([]hcn.HostComputeEndpoint, error) {
 	var hcnEPList []hcn.HostComputeEndpoint
 	for _, ep := range endpointMap {
@@ -113,6 +121,8 @@ func (hcnObj HcnMock) ListEndpointsOfNetwork(networkId string) ([]hcn.HostComput
 	return hcnEPList, nil
 }
 
+// GetEndpointByID returns the endpoint, with the aggregated VIP set
+// assigned via AddVIPToEndpoint present in its IpConfigurations.
 func (hcnObj HcnMock) GetEndpointByID(endpointId string) (*hcn.HostComputeEndpoint, error) {
 	if ep, ok := endpointMap[endpointId]; ok {
 		return ep, nil
@@ -156,9 +166,69 @@ func (hcnObj HcnMock) DeleteEndpoint(endpoint *hcn.HostComputeEndpoint) error {
 	}
 	delete(endpointMap, endpoint.Id)
 	delete(endpointMap, endpoint.Name)
+	delete(endpointVipMap, endpoint.Id)
 	return nil
 }
 
+// AddVIPToEndpoint associates vip with the shared load-balancing endpoint
+// identified by endpointID, so a single HostComputeEndpoint can front
+// multiple service VIPs instead of each workload endpoint carrying its
+// own LB policy. The VIP is added as an IP alias in the endpoint's
+// IpConfigurations, so ListEndpoints and GetEndpointByID surface it
+// without any further bookkeeping. Adding a VIP already present is a
+// no-op.
+func (hcnObj HcnMock) AddVIPToEndpoint(endpointID, vip string) error {
+	ep, ok := endpointMap[endpointID]
+	if !ok {
+		return hcn.EndpointNotFoundError{EndpointID: endpointID}
+	}
+	for _, existing := range endpointVipMap[ep.Id] {
+		if existing == vip {
+			return nil
+		}
+	}
+	endpointVipMap[ep.Id] = append(endpointVipMap[ep.Id], vip)
+	ep.IpConfigurations = append(ep.IpConfigurations, hcn.IpConfig{IpAddress: vip})
+	return nil
+}
+
+// RemoveVIPFromEndpoint removes vip from the shared load-balancing
+// endpoint identified by endpointID, including its IpConfigurations
+// alias. It returns an error if vip isn't currently associated with
+// endpointID.
+func (hcnObj HcnMock) RemoveVIPFromEndpoint(endpointID, vip string) error {
+	ep, ok := endpointMap[endpointID]
+	if !ok {
+		return hcn.EndpointNotFoundError{EndpointID: endpointID}
+	}
+	vips := endpointVipMap[ep.Id]
+	removed := false
+	for i, existing := range vips {
+		if existing == vip {
+			endpointVipMap[ep.Id] = append(vips[:i], vips[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		return fmt.Errorf("vip %s is not associated with endpoint %s", vip, endpointID)
+	}
+	for i, cfg := range ep.IpConfigurations {
+		if cfg.IpAddress == vip {
+			ep.IpConfigurations = append(ep.IpConfigurations[:i], ep.IpConfigurations[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// GetEndpointVIPs returns the aggregated set of VIPs currently assigned to
+// endpointID via AddVIPToEndpoint, letting tests assert on the shared
+// endpoint's VIP set directly instead of filtering IpConfigurations.
+func (hcnObj HcnMock) GetEndpointVIPs(endpointID string) []string {
+	return endpointVipMap[endpointID]
+}
+
 func (hcnObj HcnMock) ListLoadBalancers() ([]hcn.HostComputeLoadBalancer, error) {
 	var hcnLBList []hcn.HostComputeLoadBalancer
 	for _, lb := range loadbalancerMap {
@@ -175,6 +245,28 @@ func (hcnObj HcnMock) GetLoadBalancerByID(loadBalancerId string) (*hcn.HostCompu
 	return nil, lbNotFoundError
 }
 
+// GetLoadBalancerFlags returns the LoadBalancer-level flags and the flags
+// of its first port mapping, so tests can assert which ILB/DSR/
+// LocalRoutedVIP/PreserveDIP combination was actually requested.
+func (hcnObj HcnMock) GetLoadBalancerFlags(id string) (hcn.LoadBalancerFlags, hcn.LoadBalancerPortMappingFlags, error) {
+	lb, ok := loadbalancerMap[id]
+	if !ok {
+		return 0, 0, hcn.LoadBalancerNotFoundError{LoadBalancerId: id}
+	}
+	var portMappingFlags hcn.LoadBalancerPortMappingFlags
+	if len(lb.PortMappings) > 0 {
+		portMappingFlags = lb.PortMappings[0].Flags
+	}
+	return lb.Flags, portMappingFlags, nil
+}
+
+// FlagRejectionCount returns the number of CreateLoadBalancer/
+// UpdateLoadBalancer calls rejected so far for an invalid flag
+// combination, so tests can assert that bad requests were caught.
+func (hcnObj HcnMock) FlagRejectionCount() int {
+	return flagRejections
+}
+
 func constructLoadbalancerKeyFromFrontEndInfo(loadBalancer *hcn.HostComputeLoadBalancer) string {
 	srcVip := loadBalancer.SourceVIP
 	frontendVip := ""
@@ -185,10 +277,36 @@ func constructLoadbalancerKeyFromFrontEndInfo(loadBalancer *hcn.HostComputeLoadB
 	if len(loadBalancer.PortMappings) > 0 {
 		portMapping = loadBalancer.PortMappings[0]
 	}
-	return fmt.Sprintf("%s-%s-%v", srcVip, frontendVip, portMapping)
+	// DistributionType and Flags are named explicitly, rather than
+	// relying on the %v of the whole PortMapping, so that two LoadBalancers
+	// differing only by session affinity or traffic policy are guaranteed
+	// distinct keys.
+	return fmt.Sprintf("%s-%s-%d-%d-%d-%d-%d", srcVip, frontendVip, portMapping.Protocol, portMapping.InternalPort, portMapping.ExternalPort, portMapping.DistributionType, portMapping.Flags)
+}
+
+// validateLoadBalancerFlags rejects flag combinations that the real HNS
+// would refuse: DSR combined with IPv6 when the dual-stack capability
+// isn't present, and LocalRoutedVIP without a FrontendVIP to route to.
+func (hcnObj HcnMock) validateLoadBalancerFlags(loadBalancer *hcn.HostComputeLoadBalancer) error {
+	if loadBalancer.Flags&hcn.LoadBalancerFlagsDSR != 0 && loadBalancer.Flags&hcn.LoadBalancerFlagsIPv6 != 0 {
+		if err := hcnObj.Ipv6DualStackSupported(); err != nil {
+			flagRejections++
+			return fmt.Errorf("cannot request DSR with IPv6 flags: %w", err)
+		}
+	}
+	for _, portMapping := range loadBalancer.PortMappings {
+		if portMapping.Flags&hcn.LoadBalancerPortMappingFlagsLocalRoutedVIP != 0 && len(loadBalancer.FrontendVIPs) == 0 {
+			flagRejections++
+			return fmt.Errorf("LocalRoutedVIP flag requires a FrontendVIP")
+		}
+	}
+	return nil
 }
 
 func (hcnObj HcnMock) CreateLoadBalancer(loadBalancer *hcn.HostComputeLoadBalancer) (*hcn.HostComputeLoadBalancer, error) {
+	if err := hcnObj.validateLoadBalancerFlags(loadBalancer); err != nil {
+		return nil, err
+	}
 	if _, ok := loadbalancerMap[loadBalancer.Id]; ok {
 		return nil, fmt.Errorf("LoadBalancer id %s Already Present", loadBalancer.Id)
 	}
@@ -204,16 +322,27 @@ func (hcnObj HcnMock) CreateLoadBalancer(loadBalancer *hcn.HostComputeLoadBalanc
 }
 
 func (hcnObj HcnMock) UpdateLoadBalancer(loadBalancer *hcn.HostComputeLoadBalancer, hnsLbID string) (*hcn.HostComputeLoadBalancer, error) {
-	if _, ok := loadbalancerMap[hnsLbID]; !ok {
-		return nil, fmt.Errorf("LoadBalancer id %s Not Present", loadBalancer.Id)
+	if err := hcnObj.validateLoadBalancerFlags(loadBalancer); err != nil {
+		return nil, err
 	}
-	loadbalancerKey := constructLoadbalancerKeyFromFrontEndInfo(loadBalancer)
-	if _, ok := loadbalancerMap[loadbalancerKey]; !ok {
-		return nil, fmt.Errorf("LoadBalancer id %s Not Present", loadBalancer.Id)
+	existingLb, ok := loadbalancerMap[hnsLbID]
+	if !ok {
+		return nil, hcn.LoadBalancerNotFoundError{LoadBalancerId: hnsLbID}
+	}
+	if len(loadBalancer.HostComputeEndpoints) == 0 {
+		return nil, fmt.Errorf("updateLoadBalancer requires a non-empty endpoint list for LoadBalancer id %s", hnsLbID)
 	}
+	for _, epId := range loadBalancer.HostComputeEndpoints {
+		if _, ok := endpointMap[epId]; !ok {
+			return nil, hcn.EndpointNotFoundError{EndpointID: epId}
+		}
+	}
+	oldLoadbalancerKey := constructLoadbalancerKeyFromFrontEndInfo(existingLb)
 	loadBalancer.Id = hnsLbID
+	newLoadbalancerKey := constructLoadbalancerKeyFromFrontEndInfo(loadBalancer)
+	delete(loadbalancerMap, oldLoadbalancerKey)
 	loadbalancerMap[hnsLbID] = loadBalancer
-	loadbalancerMap[loadbalancerKey] = loadBalancer
+	loadbalancerMap[newLoadbalancerKey] = loadBalancer
 	return loadBalancer, nil
 }
 
@@ -250,6 +379,20 @@ func (hcnObj HcnMock) DsrSupported() error {
 	return errors.New("DSR Not Supported")
 }
 
+func (hcnObj HcnMock) ModifyLoadBalancerSupported() error {
+	if hcnObj.supportedFeatures.ModifyLoadbalancer {
+		return nil
+	}
+	return errors.New("modify LoadBalancer Not Supported")
+}
+
+// SetModifyLoadbalancerSupported overrides whether ModifyLoadBalancerSupported
+// reports the ModifyLoadbalancer capability as available, so tests can
+// exercise the delete-then-create fallback path without a real older HNS.
+func (hcnObj *HcnMock) SetModifyLoadbalancerSupported(supported bool) {
+	hcnObj.supportedFeatures.ModifyLoadbalancer = supported
+}
+
 func (hcnObj HcnMock) DeleteAllHnsLoadBalancerPolicy() {
 	for k := range loadbalancerMap {
 		delete(loadbalancerMap, k)
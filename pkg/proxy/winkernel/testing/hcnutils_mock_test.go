@@ -0,0 +1,279 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"testing"
+
+	"github.com/Microsoft/hnslib/hcn"
+)
+
+func newTestNetwork() *hcn.HostComputeNetwork {
+	return &hcn.HostComputeNetwork{Id: "NETID-1", Name: "test-network"}
+}
+
+// TestUpdateLoadBalancerDistributionType verifies that flipping a Service's
+// session affinity reconciles the existing HNS load balancer in place,
+// rather than deleting and recreating it, when ModifyLoadbalancer is
+// supported.
+func TestUpdateLoadBalancerDistributionType(t *testing.T) {
+	hcnMock := NewHcnMock(newTestNetwork())
+
+	ep, err := hcnMock.CreateEndpoint(hcnMock.network, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+
+	lb := &hcn.HostComputeLoadBalancer{
+		HostComputeEndpoints: []string{ep.Id},
+		SourceVIP:            "10.0.0.1",
+		FrontendVIPs:         []string{"10.0.0.100"},
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{
+				Protocol:         6,
+				InternalPort:     80,
+				ExternalPort:     80,
+				DistributionType: hcn.LoadBalancerDistribution(0),
+			},
+		},
+	}
+	created, err := hcnMock.CreateLoadBalancer(lb)
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	// Flip session affinity to ClientIP (DistributionType 2) on the
+	// existing load balancer and reconcile via UpdateLoadBalancer.
+	updated := &hcn.HostComputeLoadBalancer{
+		HostComputeEndpoints: []string{ep.Id},
+		SourceVIP:            lb.SourceVIP,
+		FrontendVIPs:         lb.FrontendVIPs,
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{
+				Protocol:         6,
+				InternalPort:     80,
+				ExternalPort:     80,
+				DistributionType: hcn.LoadBalancerDistribution(2),
+			},
+		},
+	}
+	result, err := hcnMock.UpdateLoadBalancer(updated, created.Id)
+	if err != nil {
+		t.Fatalf("unexpected error reconciling load balancer: %v", err)
+	}
+	if result.Id != created.Id {
+		t.Errorf("expected UpdateLoadBalancer to keep id %s, got %s", created.Id, result.Id)
+	}
+	if result.PortMappings[0].DistributionType != hcn.LoadBalancerDistribution(2) {
+		t.Errorf("expected DistributionType 2 after reconcile, got %v", result.PortMappings[0].DistributionType)
+	}
+
+	// The old key must not linger, and the load balancer should still be
+	// reachable by its id.
+	if _, err := hcnMock.GetLoadBalancerByID(created.Id); err != nil {
+		t.Errorf("expected load balancer %s to still be present: %v", created.Id, err)
+	}
+	if _, ok := loadbalancerMap[constructLoadbalancerKeyFromFrontEndInfo(created)]; ok {
+		t.Errorf("expected the old frontend key of load balancer %s to be removed", created.Id)
+	}
+
+	all, err := hcnMock.ListLoadBalancers()
+	if err != nil {
+		t.Fatalf("unexpected error listing load balancers: %v", err)
+	}
+	for _, lb := range all {
+		if lb.Id != created.Id {
+			t.Errorf("expected every listed entry to resolve to load balancer %s, got %s", created.Id, lb.Id)
+		}
+	}
+}
+
+// TestAddVIPToEndpointSharesOneEndpointAcrossServices verifies the shared
+// load-balancing endpoint model: N services only ever add VIPs to a
+// single shared endpoint, so the endpoint count stays O(1) instead of
+// growing with the number of services.
+func TestAddVIPToEndpointSharesOneEndpointAcrossServices(t *testing.T) {
+	hcnMock := NewHcnMock(newTestNetwork())
+
+	shared, err := hcnMock.CreateEndpoint(hcnMock.network, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating shared endpoint: %v", err)
+	}
+
+	services := []string{"10.0.0.10", "10.0.0.11", "10.0.0.12"}
+	for _, vip := range services {
+		if err := hcnMock.AddVIPToEndpoint(shared.Id, vip); err != nil {
+			t.Fatalf("unexpected error adding vip %s: %v", vip, err)
+		}
+	}
+
+	// Adding the same VIP again (e.g. a re-sync of the same Service) must
+	// be idempotent.
+	if err := hcnMock.AddVIPToEndpoint(shared.Id, services[0]); err != nil {
+		t.Fatalf("unexpected error re-adding vip %s: %v", services[0], err)
+	}
+
+	gotVips := hcnMock.GetEndpointVIPs(shared.Id)
+	if len(gotVips) != len(services) {
+		t.Fatalf("expected %d VIPs on shared endpoint, got %d: %v", len(services), len(gotVips), gotVips)
+	}
+
+	ep, err := hcnMock.GetEndpointByID(shared.Id)
+	if err != nil {
+		t.Fatalf("unexpected error getting endpoint: %v", err)
+	}
+	if len(ep.IpConfigurations) != len(services) {
+		t.Errorf("expected GetEndpointByID to surface %d VIPs via IpConfigurations, got %d", len(services), len(ep.IpConfigurations))
+	}
+
+	all, err := hcnMock.ListEndpoints()
+	if err != nil {
+		t.Fatalf("unexpected error listing endpoints: %v", err)
+	}
+	// ListEndpoints ranges over endpointMap, which indexes each endpoint
+	// under both its Id and its Name, so every endpoint appears twice;
+	// dedupe by Id before counting distinct endpoints.
+	seenIds := make(map[string]bool)
+	for _, e := range all {
+		if e.Id == shared.Id && !seenIds[e.Id] {
+			if len(e.IpConfigurations) != len(services) {
+				t.Errorf("expected ListEndpoints to surface %d VIPs via IpConfigurations, got %d", len(services), len(e.IpConfigurations))
+			}
+		}
+		seenIds[e.Id] = true
+	}
+	if endpointCount := len(seenIds); endpointCount != 1 {
+		t.Errorf("expected exactly one shared endpoint regardless of service count, got %d", endpointCount)
+	}
+}
+
+func TestRemoveVIPFromEndpoint(t *testing.T) {
+	hcnMock := NewHcnMock(newTestNetwork())
+
+	shared, err := hcnMock.CreateEndpoint(hcnMock.network, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating shared endpoint: %v", err)
+	}
+	if err := hcnMock.AddVIPToEndpoint(shared.Id, "10.0.0.10"); err != nil {
+		t.Fatalf("unexpected error adding vip: %v", err)
+	}
+
+	if err := hcnMock.RemoveVIPFromEndpoint(shared.Id, "10.0.0.10"); err != nil {
+		t.Fatalf("unexpected error removing vip: %v", err)
+	}
+	if vips := hcnMock.GetEndpointVIPs(shared.Id); len(vips) != 0 {
+		t.Errorf("expected no VIPs after removal, got %v", vips)
+	}
+	ep, err := hcnMock.GetEndpointByID(shared.Id)
+	if err != nil {
+		t.Fatalf("unexpected error getting endpoint: %v", err)
+	}
+	if len(ep.IpConfigurations) != 0 {
+		t.Errorf("expected IpConfigurations to drop the removed VIP, got %v", ep.IpConfigurations)
+	}
+
+	if err := hcnMock.RemoveVIPFromEndpoint(shared.Id, "10.0.0.99"); err == nil {
+		t.Error("expected removing an unassociated vip to return an error")
+	}
+}
+
+func TestCreateLoadBalancerRejectsDSRWithIPv6WithoutDualStack(t *testing.T) {
+	hcnMock := NewHcnMock(newTestNetwork())
+	hcnMock.supportedFeatures.IPv6DualStack = false
+
+	before := hcnMock.FlagRejectionCount()
+	lb := &hcn.HostComputeLoadBalancer{
+		SourceVIP:    "10.0.0.1",
+		FrontendVIPs: []string{"10.0.0.100"},
+		Flags:        hcn.LoadBalancerFlagsDSR | hcn.LoadBalancerFlagsIPv6,
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{Protocol: 6, InternalPort: 80, ExternalPort: 80},
+		},
+	}
+
+	if _, err := hcnMock.CreateLoadBalancer(lb); err == nil {
+		t.Fatal("expected DSR+IPv6 to be rejected when dual-stack isn't supported")
+	}
+	if got := hcnMock.FlagRejectionCount(); got != before+1 {
+		t.Errorf("expected FlagRejectionCount to be %d, got %d", before+1, got)
+	}
+}
+
+func TestCreateLoadBalancerRejectsLocalRoutedVIPWithoutFrontendVIP(t *testing.T) {
+	hcnMock := NewHcnMock(newTestNetwork())
+
+	before := hcnMock.FlagRejectionCount()
+	lb := &hcn.HostComputeLoadBalancer{
+		SourceVIP: "10.0.0.1",
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{
+				Protocol:     6,
+				InternalPort: 80,
+				ExternalPort: 80,
+				Flags:        hcn.LoadBalancerPortMappingFlagsLocalRoutedVIP,
+			},
+		},
+	}
+
+	if _, err := hcnMock.CreateLoadBalancer(lb); err == nil {
+		t.Fatal("expected LocalRoutedVIP without a FrontendVIP to be rejected")
+	}
+	if got := hcnMock.FlagRejectionCount(); got != before+1 {
+		t.Errorf("expected FlagRejectionCount to be %d, got %d", before+1, got)
+	}
+}
+
+func TestGetLoadBalancerFlags(t *testing.T) {
+	hcnMock := NewHcnMock(newTestNetwork())
+
+	ep, err := hcnMock.CreateEndpoint(hcnMock.network, &hcn.HostComputeEndpoint{})
+	if err != nil {
+		t.Fatalf("unexpected error creating endpoint: %v", err)
+	}
+	lb := &hcn.HostComputeLoadBalancer{
+		HostComputeEndpoints: []string{ep.Id},
+		SourceVIP:            "10.0.0.1",
+		FrontendVIPs:         []string{"10.0.0.100"},
+		Flags:                hcn.LoadBalancerFlagsDSR,
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{
+				Protocol:     6,
+				InternalPort: 80,
+				ExternalPort: 80,
+				Flags:        hcn.LoadBalancerPortMappingFlagsILB,
+			},
+		},
+	}
+	created, err := hcnMock.CreateLoadBalancer(lb)
+	if err != nil {
+		t.Fatalf("unexpected error creating load balancer: %v", err)
+	}
+
+	lbFlags, portMappingFlags, err := hcnMock.GetLoadBalancerFlags(created.Id)
+	if err != nil {
+		t.Fatalf("unexpected error getting load balancer flags: %v", err)
+	}
+	if lbFlags != hcn.LoadBalancerFlagsDSR {
+		t.Errorf("expected LoadBalancerFlagsDSR, got %v", lbFlags)
+	}
+	if portMappingFlags != hcn.LoadBalancerPortMappingFlagsILB {
+		t.Errorf("expected LoadBalancerPortMappingFlagsILB, got %v", portMappingFlags)
+	}
+}